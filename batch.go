@@ -0,0 +1,219 @@
+package graphql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/shurcooL/graphql/internal/jsonutil"
+)
+
+// persistedQueryExtension is the `extensions.persistedQuery` object Automatic Persisted Queries
+// attaches to a request.
+type persistedQueryExtension struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+// encodeOperation builds the JSON body for a single GraphQL operation. query is omitted from
+// the body when empty, so a persisted-query request can send just the hash.
+func encodeOperation(query string, variables map[string]interface{}, persisted *persistedQueryExtension) ([]byte, error) {
+	in := struct {
+		Query      string                 `json:"query,omitempty"`
+		Variables  map[string]interface{} `json:"variables,omitempty"`
+		Extensions map[string]interface{} `json:"extensions,omitempty"`
+	}{
+		Query:     query,
+		Variables: variables,
+	}
+	if persisted != nil {
+		in.Extensions = map[string]interface{}{"persistedQuery": persisted}
+	}
+	return json.Marshal(in)
+}
+
+// sha256Hex returns the hex-encoded SHA-256 digest of s, as required by the Automatic
+// Persisted Queries protocol.
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// isPersistedQueryNotFound reports whether err is the GraphQL error a server sends when it
+// doesn't recognize a persisted query's hash.
+func isPersistedQueryNotFound(err error) bool {
+	var gqlErrs GQLErrors
+	if !errors.As(err, &gqlErrs) {
+		return false
+	}
+	for _, e := range gqlErrs {
+		if e.Message == "PersistedQueryNotFound" || e.Extensions["code"] == "PERSISTED_QUERY_NOT_FOUND" {
+			return true
+		}
+	}
+	return false
+}
+
+// PersistedQueryCache remembers which queries the server has already confirmed it has
+// persisted, identified by the SHA-256 hash of their text, so WithPersistedQueries can skip
+// resending a query's full text once the server already knows it.
+type PersistedQueryCache interface {
+	// Known reports whether the query with the given hash is known to be persisted server-side.
+	Known(hash string) bool
+	// Remember records that the query with the given hash is now persisted server-side.
+	Remember(hash string)
+}
+
+// memoryPersistedQueryCache is an in-memory PersistedQueryCache. It never evicts entries: a
+// process issuing a bounded set of query shapes will hold a bounded set of hashes.
+type memoryPersistedQueryCache struct {
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+// NewPersistedQueryCache returns a PersistedQueryCache backed by an in-memory map, suitable for
+// the common case of a long-lived Client issuing the same query shapes repeatedly.
+func NewPersistedQueryCache() PersistedQueryCache {
+	return &memoryPersistedQueryCache{known: make(map[string]bool)}
+}
+
+func (c *memoryPersistedQueryCache) Known(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.known[hash]
+}
+
+func (c *memoryPersistedQueryCache) Remember(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.known[hash] = true
+}
+
+// executePersisted implements the Automatic Persisted Queries protocol for a single operation.
+// If the cache already believes the server has this query's hash, it sends the hash alone,
+// falling back to the full query text only if the server reports PersistedQueryNotFound (e.g.
+// because its own cache evicted it). Otherwise it sends the hash and the full text together,
+// establishing it server-side for next time.
+func (c *Client) executePersisted(ctx context.Context, opName, query string, variables map[string]interface{}, v interface{}) error {
+	hash := sha256Hex(query)
+	persisted := &persistedQueryExtension{Version: 1, Sha256Hash: hash}
+
+	if c.persistedQueries.Known(hash) {
+		body, err := encodeOperation("", variables, persisted)
+		if err != nil {
+			return err
+		}
+		err = c.send(ctx, opName, body, v)
+		if err == nil || !isPersistedQueryNotFound(err) {
+			return err
+		}
+		// The server forgot this hash; fall through and re-establish it below.
+	}
+
+	body, err := encodeOperation(query, variables, persisted)
+	if err != nil {
+		return err
+	}
+	if err := c.send(ctx, opName, body, v); err != nil {
+		return err
+	}
+	c.persistedQueries.Remember(hash)
+	return nil
+}
+
+// BatchOp is a single operation to include in a QueryBatch call. Set exactly one of Query or
+// Mutation to a pointer to a struct corresponding to the GraphQL schema, using the same
+// struct-tag conventions as Client.Query/Client.Mutate; the response is unmarshaled into
+// whichever one is set.
+type BatchOp struct {
+	Query     interface{}
+	Mutation  interface{}
+	Variables map[string]interface{}
+}
+
+// BatchErrors collects the per-operation errors from a QueryBatch call, keyed by the index of
+// the failing BatchOp.
+type BatchErrors map[int]error
+
+// Error implements error interface.
+func (e BatchErrors) Error() string {
+	return fmt.Sprintf("graphql: %d batched operation(s) failed", len(e))
+}
+
+// QueryBatch packs ops into a single JSON-array POST and demuxes the array response back into
+// each op's Query or Mutation destination. It composes with the Client's rate-limit retry path
+// the same way a single Query or Mutate call does, but not with WithPersistedQueries: batched
+// operations always send their full query text.
+func (c *Client) QueryBatch(ctx context.Context, ops []BatchOp) error {
+	type batchIn struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables,omitempty"`
+	}
+	in := make([]batchIn, len(ops))
+	for i, op := range ops {
+		switch {
+		case op.Query != nil:
+			in[i] = batchIn{Query: constructQuery(op.Query, op.Variables), Variables: op.Variables}
+		case op.Mutation != nil:
+			in[i] = batchIn{Query: constructMutation(op.Mutation, op.Variables), Variables: op.Variables}
+		default:
+			return fmt.Errorf("graphql: batch operation %d sets neither Query nor Mutation", i)
+		}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	respBody, err := c.sendRaw(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	var out []struct {
+		Data   *json.RawMessage
+		Errors GQLErrors
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return err
+	}
+	if len(out) != len(ops) {
+		return fmt.Errorf("graphql: batch response had %d entries, want %d", len(out), len(ops))
+	}
+
+	batchErrs := make(BatchErrors)
+	for i, entry := range out {
+		if cost := extractRateLimitCost(entry.Data); cost != nil {
+			c.emitEvent(RateLimitEvent{Type: RateLimitEventCost, Cost: cost})
+			if c.querySink != nil {
+				op := "query"
+				if ops[i].Query == nil {
+					op = "mutation"
+				}
+				c.querySink(op, cost.Cost, cost.Remaining, cost.ResetAt)
+			}
+		}
+		if len(entry.Errors) > 0 {
+			batchErrs[i] = entry.Errors
+			continue
+		}
+		if entry.Data == nil {
+			continue
+		}
+		dest := ops[i].Query
+		if dest == nil {
+			dest = ops[i].Mutation
+		}
+		if err := jsonutil.UnmarshalGraphQL(*entry.Data, dest); err != nil {
+			batchErrs[i] = err
+		}
+	}
+	if len(batchErrs) > 0 {
+		return batchErrs
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in []struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		if len(in) != 2 {
+			t.Fatalf("got %d batched ops, want 2", len(in))
+		}
+		w.Write([]byte(`[
+			{"data": {"name": "alice"}},
+			{"errors": [{"message": "not found"}]}
+		]`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL)
+
+	var q1 struct {
+		Name string
+	}
+	var q2 struct {
+		Name string
+	}
+	ops := []BatchOp{
+		{Query: &q1},
+		{Query: &q2},
+	}
+
+	err := c.QueryBatch(context.Background(), ops)
+	batchErrs, ok := err.(BatchErrors)
+	if !ok {
+		t.Fatalf("QueryBatch() error = %v (%T), want BatchErrors", err, err)
+	}
+	if len(batchErrs) != 1 {
+		t.Fatalf("len(BatchErrors) = %d, want 1", len(batchErrs))
+	}
+	if _, ok := batchErrs[1]; !ok {
+		t.Errorf("BatchErrors missing entry for index 1")
+	}
+	if q1.Name != "alice" {
+		t.Errorf("q1.Name = %q, want %q", q1.Name, "alice")
+	}
+}
@@ -7,28 +7,131 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/shurcooL/graphql/internal/jsonutil"
-	"golang.org/x/net/context/ctxhttp"
 )
 
 // Client is a GraphQL client.
 type Client struct {
 	url        string // GraphQL server URL.
 	httpClient *http.Client
+
+	headers      http.Header
+	headerFunc   func(ctx context.Context) http.Header
+	requestHook  func(*http.Request)
+	responseHook func(*http.Response, time.Duration)
+	querySink    func(op string, cost, remaining int, resetAt time.Time)
+
+	rlMu             sync.Mutex // guards rateLimitHandler
+	rateLimitHandler RateLimitHandler
+	events           chan RateLimitEvent
+
+	persistedQueries PersistedQueryCache
+
+	initPayload InitPayload
+	wsMu        sync.Mutex
+	wsConn      *wsConn
+}
+
+// ClientOption configures a Client constructed by NewClient.
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the http.Client used to perform requests. The default is
+// http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithHeader adds a static header to every request the Client sends, e.g. a long-lived
+// Authorization bearer token.
+func WithHeader(key, value string) ClientOption {
+	return func(c *Client) { c.headers.Add(key, value) }
+}
+
+// WithHeaderFunc adds headers computed per request from ctx, for bearer tokens or JWTs that
+// need to be refreshed or rotated between calls rather than set once at construction time.
+func WithHeaderFunc(f func(ctx context.Context) http.Header) ClientOption {
+	return func(c *Client) { c.headerFunc = f }
+}
+
+// WithRequestHook registers a callback invoked with the outgoing *http.Request just before
+// it's sent, for tracing spans or request logging.
+func WithRequestHook(f func(*http.Request)) ClientOption {
+	return func(c *Client) { c.requestHook = f }
 }
 
-// NewClient creates a GraphQL client targeting the specified GraphQL server URL.
-// If httpClient is nil, then http.DefaultClient is used.
-func NewClient(url string, httpClient *http.Client) *Client {
-	if httpClient == nil {
-		httpClient = http.DefaultClient
+// WithResponseHook registers a callback invoked with the *http.Response and the request's
+// duration once it completes, for latency metrics or closing out a tracing span.
+func WithResponseHook(f func(*http.Response, time.Duration)) ClientOption {
+	return func(c *Client) { c.responseHook = f }
+}
+
+// WithQueryCostSink registers a callback invoked whenever a response carries a
+// `rateLimit { cost, remaining, resetAt }` node, so callers can track their own GraphQL query
+// cost budget against the server's. op is "query", "mutation", or "subscription".
+func WithQueryCostSink(f func(op string, cost, remaining int, resetAt time.Time)) ClientOption {
+	return func(c *Client) { c.querySink = f }
+}
+
+// WithPersistedQueries enables Automatic Persisted Queries: every request carries the query's
+// SHA-256 hash. A query that cache doesn't yet know is sent with its full text alongside the
+// hash; once the server has accepted it, cache remembers the hash and later calls for the same
+// query send the hash alone, falling back to the full text only when the server reports
+// PersistedQueryNotFound. Passing a nil cache uses an in-memory NewPersistedQueryCache().
+func WithPersistedQueries(cache PersistedQueryCache) ClientOption {
+	if cache == nil {
+		cache = NewPersistedQueryCache()
 	}
-	return &Client{
+	return func(c *Client) { c.persistedQueries = cache }
+}
+
+// NewClient creates a GraphQL client targeting the specified GraphQL server URL, configured by
+// opts. With no options, requests are sent with http.DefaultClient and no extra headers.
+func NewClient(url string, opts ...ClientOption) *Client {
+	c := &Client{
 		url:        url,
-		httpClient: httpClient,
+		httpClient: http.DefaultClient,
+		headers:    make(http.Header),
+
+		rateLimitHandler: &GitHubRateLimitHandler{},
+		events:           make(chan RateLimitEvent, 16),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetRateLimitHandler replaces the RateLimitHandler used by Query and Mutate to decide whether
+// a non-200 response should be retried. The default is a *GitHubRateLimitHandler. Safe to call
+// concurrently with in-flight requests.
+func (c *Client) SetRateLimitHandler(h RateLimitHandler) {
+	c.rlMu.Lock()
+	c.rateLimitHandler = h
+	c.rlMu.Unlock()
+}
+
+func (c *Client) getRateLimitHandler() RateLimitHandler {
+	c.rlMu.Lock()
+	defer c.rlMu.Unlock()
+	return c.rateLimitHandler
+}
+
+// Events returns a channel of RateLimitEvent values emitted whenever do waits out a rate limit
+// or observes a GraphQL rateLimit cost node, so callers can report retry progress. The channel
+// is unbuffered past its internal capacity: events are dropped rather than block the request if
+// nobody is reading.
+func (c *Client) Events() <-chan RateLimitEvent {
+	return c.events
+}
+
+func (c *Client) emitEvent(e RateLimitEvent) {
+	select {
+	case c.events <- e:
+	default:
 	}
 }
 
@@ -36,98 +139,97 @@ func NewClient(url string, httpClient *http.Client) *Client {
 // with a query derived from q, populating the response into it.
 // q should be a pointer to struct that corresponds to the GraphQL schema.
 func (c *Client) Query(ctx context.Context, q interface{}, variables map[string]interface{}) error {
-	return c.do(ctx, queryOperation, q, variables, 0, 1)
+	return c.do(ctx, queryOperation, q, variables)
 }
 
-// Query executes a single GraphQL query request,
-// with a query derived from q, populating the response into it.
-// q should be a pointer to struct that corresponds to the GraphQL schema.
-// Retry on github secondary rate limit error
+// QueryRetry executes a single GraphQL query request, with a query derived from q, populating
+// the response into it.
+//
+// Deprecated: retries are now handled uniformly by Query via the Client's RateLimitHandler
+// (see SetRateLimitHandler). The timeout and retryCount parameters are ignored; QueryRetry is
+// kept only so existing callers keep compiling, and is equivalent to Query.
 func (c *Client) QueryRetry(ctx context.Context, q interface{}, variables map[string]interface{}, timeout, retryCount int) error {
-	return c.do(ctx, queryOperation, q, variables, timeout, retryCount)
+	return c.do(ctx, queryOperation, q, variables)
 }
 
 // Mutate executes a single GraphQL mutation request,
 // with a mutation derived from m, populating the response into it.
 // m should be a pointer to struct that corresponds to the GraphQL schema.
 func (c *Client) Mutate(ctx context.Context, m interface{}, variables map[string]interface{}) error {
-	return c.do(ctx, mutationOperation, m, variables, 0, 0)
+	return c.do(ctx, mutationOperation, m, variables)
+}
+
+// QueryRaw executes query, a literal GraphQL document, populating the response into out. Unlike
+// Query, which derives its document from out's struct tags via constructQuery, QueryRaw is for
+// callers who already have a query string on hand — generated ones, or ones using fragments or
+// directives constructQuery can't express. out should be a pointer to a struct whose fields
+// correspond to query's top-level selections.
+func (c *Client) QueryRaw(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	return c.execute(ctx, "query", query, variables, out)
+}
+
+// MutateRaw executes query, a literal GraphQL mutation document, the same way QueryRaw does for
+// queries.
+func (c *Client) MutateRaw(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	return c.execute(ctx, "mutation", query, variables, out)
 }
 
-// do executes a single GraphQL operation.
-func (c *Client) do(ctx context.Context, op operationType, v interface{}, variables map[string]interface{}, timeout, retryCount int) error {
-	var query string
+// do executes a single GraphQL operation. Both Query and Mutate retry through it uniformly: a
+// non-200 response is handed to c.rateLimitHandler, which decides whether to sleep and retry or
+// give up.
+func (c *Client) do(ctx context.Context, op operationType, v interface{}, variables map[string]interface{}) error {
+	var query, opName string
 	switch op {
 	case queryOperation:
-		query = constructQuery(v, variables)
+		query, opName = constructQuery(v, variables), "query"
 	case mutationOperation:
-		query = constructMutation(v, variables)
+		query, opName = constructMutation(v, variables), "mutation"
 	}
-	in := struct {
-		Query     string                 `json:"query"`
-		Variables map[string]interface{} `json:"variables,omitempty"`
-	}{
-		Query:     query,
-		Variables: variables,
+	return c.execute(ctx, opName, query, variables, v)
+}
+
+// execute sends query to the server and decodes its response into v. It's the shared transport
+// path for the struct-tag-derived Query/Mutate and the raw-string QueryRaw/MutateRaw. opName is
+// "query" or "mutation", and is only used to label the WithQueryCostSink callback.
+//
+// When persisted queries are enabled (WithPersistedQueries), this defers to executePersisted
+// instead of sending query's full text on every call.
+func (c *Client) execute(ctx context.Context, opName, query string, variables map[string]interface{}, v interface{}) error {
+	if c.persistedQueries != nil {
+		return c.executePersisted(ctx, opName, query, variables, v)
 	}
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(in)
+	body, err := encodeOperation(query, variables, nil)
 	if err != nil {
 		return err
 	}
+	return c.send(ctx, opName, body, v)
+}
 
-	var resp *http.Response
-
-	for r := 0; r <= retryCount; r++ {
-		if timeout > 0 {
-			t := time.After(time.Duration(timeout) * time.Second)
-			select {
-			case <-t:
-				return fmt.Errorf("timed out retrying with secondary rate limit reached on %s", c.url)
-			default:
-			}
-		}
-
-		resp, err = ctxhttp.Post(ctx, c.httpClient, c.url, "application/json", &buf)
-		if err != nil {
-			return err
-		}
-
-		if resp.StatusCode == http.StatusForbidden {
-			retryAfter := resp.Header.Get("Retry-After")
-			// Secondary rate limit encountered. retrying
-			if retryAfter != "" {
-				timeout, err := strconv.Atoi(retryAfter)
-				if err != nil {
-					return err
-				}
-				time.Sleep(time.Duration(timeout) * time.Second)
-				continue
-
-			}
-		}
-		break
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("non-200 OK status code: %v body: %q", resp.Status, body)
+// send POSTs an already-encoded operation body and decodes its response into v, retrying
+// through c.rateLimitHandler on non-200 responses.
+func (c *Client) send(ctx context.Context, opName string, body []byte, v interface{}) error {
+	respBody, err := c.sendRaw(ctx, body)
+	if err != nil {
+		return err
 	}
 
 	var out struct {
 		Data   *json.RawMessage
-		Errors errors
+		Errors GQLErrors
 		//Extensions interface{} // Unused.
 	}
-	err = json.NewDecoder(resp.Body).Decode(&out)
-	if err != nil {
+	if err := json.Unmarshal(respBody, &out); err != nil {
 		// TODO: Consider including response body in returned error, if deemed helpful.
 		return err
 	}
+	if cost := extractRateLimitCost(out.Data); cost != nil {
+		c.emitEvent(RateLimitEvent{Type: RateLimitEventCost, Cost: cost})
+		if c.querySink != nil {
+			c.querySink(opName, cost.Cost, cost.Remaining, cost.ResetAt)
+		}
+	}
 	if out.Data != nil {
-		err := jsonutil.UnmarshalGraphQL(*out.Data, v)
-		if err != nil {
+		if err := jsonutil.UnmarshalGraphQL(*out.Data, v); err != nil {
 			// TODO: Consider including response body in returned error, if deemed helpful.
 			return err
 		}
@@ -138,21 +240,125 @@ func (c *Client) do(ctx context.Context, op operationType, v interface{}, variab
 	return nil
 }
 
-// errors represents the "errors" array in a response from a GraphQL server.
-// If returned via error interface, the slice is expected to contain at least 1 element.
+// sendRaw POSTs an already-encoded request body and returns the raw response body, retrying
+// through c.rateLimitHandler on non-200 responses. It's the transport primitive shared by send
+// (single operations) and QueryBatch (array bodies, which decode differently).
+func (c *Client) sendRaw(ctx context.Context, body []byte) ([]byte, error) {
+	var respBody []byte
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, vs := range c.headers {
+			req.Header[k] = append(req.Header[k], vs...)
+		}
+		if c.headerFunc != nil {
+			for k, vs := range c.headerFunc(ctx) {
+				req.Header[k] = append(req.Header[k], vs...)
+			}
+		}
+		if c.requestHook != nil {
+			c.requestHook(req)
+		}
+
+		start := time.Now()
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if c.responseHook != nil {
+			c.responseHook(resp, time.Since(start))
+		}
+		respBody, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+
+		wait, retry := c.getRateLimitHandler().Handle(resp, respBody, attempt)
+		if !retry {
+			return nil, fmt.Errorf("non-200 OK status code: %v body: %q", resp.Status, respBody)
+		}
+		c.emitEvent(rateLimitEventFor(resp, wait, attempt))
+		if err := waitForContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+	return respBody, nil
+}
+
+// rateLimitEventFor classifies which of GitHub's rate-limit signals a non-200 response
+// represents, for the purposes of the event sent on Client.Events.
+func rateLimitEventFor(resp *http.Response, wait time.Duration, attempt int) RateLimitEvent {
+	typ := RateLimitEventAbuse
+	switch {
+	case resp.Header.Get("X-RateLimit-Remaining") == "0":
+		typ = RateLimitEventPrimary
+	case resp.Header.Get("Retry-After") != "":
+		typ = RateLimitEventSecondary
+	}
+	return RateLimitEvent{Type: typ, Wait: wait, Attempt: attempt}
+}
+
+// extractRateLimitCost pulls the `rateLimit { cost, remaining, resetAt }` node out of a
+// GraphQL response's data, if the originating query requested it. It returns nil otherwise.
+func extractRateLimitCost(data *json.RawMessage) *RateLimitCost {
+	if data == nil {
+		return nil
+	}
+	var probe struct {
+		RateLimit *RateLimitCost `json:"rateLimit"`
+	}
+	if err := json.Unmarshal(*data, &probe); err != nil {
+		return nil
+	}
+	return probe.RateLimit
+}
+
+// GQLError represents a single entry in the "errors" array of a GraphQL response, per the
+// current spec, including the Path and Extensions fields GitHub and most servers populate
+// (e.g. extensions.code "RATE_LIMITED" or "NOT_FOUND").
 //
-// Specification: https://facebook.github.io/graphql/#sec-Errors.
-type errors []struct {
+// Specification: https://spec.graphql.org/October2021/#sec-Errors.
+type GQLError struct {
 	Message   string
 	Locations []struct {
 		Line   int
 		Column int
 	}
+	Path       []interface{}
+	Extensions map[string]interface{}
+}
+
+// Error implements error interface.
+func (e GQLError) Error() string {
+	return e.Message
 }
 
+// GQLErrors represents the "errors" array in a response from a GraphQL server.
+// If returned via error interface, the slice is expected to contain at least 1 element.
+//
+// Use errors.As to recover a GQLErrors (or a single GQLError, by ranging over it) from an error
+// returned by Query, Mutate, or their Raw/Retry variants, e.g. to branch on
+// err[0].Extensions["code"].
+type GQLErrors []GQLError
+
 // Error implements error interface.
-func (e errors) Error() string {
-	return e[0].Message
+func (e GQLErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Message
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Message
+	}
+	return strings.Join(msgs, "; ")
 }
 
 type operationType uint8
@@ -160,5 +366,5 @@ type operationType uint8
 const (
 	queryOperation operationType = iota
 	mutationOperation
-	//subscriptionOperation // Unused.
+	subscriptionOperation
 )
@@ -0,0 +1,135 @@
+package graphql
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimitEventType identifies which of GitHub's rate-limit signals triggered a RateLimitEvent.
+type RateLimitEventType uint8
+
+const (
+	// RateLimitEventPrimary fires when the primary X-RateLimit-Remaining bucket is exhausted.
+	RateLimitEventPrimary RateLimitEventType = iota
+	// RateLimitEventSecondary fires on a Retry-After header (secondary/abuse rate limit).
+	RateLimitEventSecondary
+	// RateLimitEventAbuse fires on a 403 response whose body reports a secondary rate limit,
+	// but without a Retry-After header to size the wait.
+	RateLimitEventAbuse
+	// RateLimitEventCost fires when the GraphQL response's rateLimit node is observed.
+	RateLimitEventCost
+)
+
+// RateLimitEvent describes a single rate-limit related sleep or observation, for callers that
+// want to surface retry/backoff progress to a user. These are sent on the channel returned by
+// Client.Events.
+type RateLimitEvent struct {
+	Type    RateLimitEventType
+	Wait    time.Duration
+	Attempt int
+	Cost    *RateLimitCost
+}
+
+// RateLimitCost is the `rateLimit { cost, remaining, resetAt }` node GitHub's GraphQL API
+// returns when a query asks for it.
+type RateLimitCost struct {
+	Cost      int       `json:"cost"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"resetAt"`
+}
+
+// RateLimitHandler inspects a non-200 response and decides whether the caller should wait
+// before retrying the request. Returning retry == false causes do to return the response's
+// body as an error immediately.
+type RateLimitHandler interface {
+	Handle(resp *http.Response, body []byte, attempt int) (wait time.Duration, retry bool)
+}
+
+// defaultMaxRetries bounds how many times GitHubRateLimitHandler reports retry == true before
+// giving up and letting the caller see the underlying error.
+const defaultMaxRetries = 5
+
+// GitHubRateLimitHandler is the default RateLimitHandler. It recognizes the signals GitHub's
+// REST/GraphQL APIs use to communicate rate limiting:
+//   - the X-RateLimit-Remaining / X-RateLimit-Reset primary bucket,
+//   - the Retry-After header used for secondary/abuse limits,
+//   - a 403 response whose body mentions a "secondary rate limit" with no Retry-After.
+//
+// The `rateLimit { cost, remaining, resetAt }` GraphQL node is handled separately by do, since
+// it's only available once a response has been successfully decoded.
+type GitHubRateLimitHandler struct {
+	// MaxRetries bounds how many times Handle reports retry == true. Zero means defaultMaxRetries.
+	MaxRetries int
+}
+
+func (h *GitHubRateLimitHandler) maxRetries() int {
+	if h.MaxRetries > 0 {
+		return h.MaxRetries
+	}
+	return defaultMaxRetries
+}
+
+// Handle implements RateLimitHandler.
+func (h *GitHubRateLimitHandler) Handle(resp *http.Response, body []byte, attempt int) (time.Duration, bool) {
+	if attempt >= h.maxRetries() {
+		return 0, false
+	}
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if secs, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+
+	if resp.StatusCode == http.StatusForbidden {
+		if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining == "0" {
+			if reset := resp.Header.Get("X-RateLimit-Reset"); reset != "" {
+				if epoch, err := strconv.ParseInt(reset, 10, 64); err == nil {
+					if wait := time.Until(time.Unix(epoch, 0)); wait > 0 {
+						return wait, true
+					}
+				}
+			}
+		}
+		if isSecondaryRateLimitBody(body) {
+			return backoff(attempt), true
+		}
+	}
+
+	return 0, false
+}
+
+// backoff returns an exponential backoff duration with jitter for the given attempt, starting
+// at roughly 1s and capping at 30s.
+func backoff(attempt int) time.Duration {
+	base := 30 * time.Second
+	if attempt < 5 {
+		base = time.Second << uint(attempt)
+	}
+	return base/2 + time.Duration(rand.Int63n(int64(base)/2+1))
+}
+
+// isSecondaryRateLimitBody reports whether body is GitHub's 403 response for hitting a
+// secondary (abuse) rate limit.
+func isSecondaryRateLimitBody(body []byte) bool {
+	return strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+}
+
+// waitForContext sleeps for d, returning ctx.Err() if ctx is done first.
+func waitForContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
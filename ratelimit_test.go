@@ -0,0 +1,77 @@
+package graphql
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGitHubRateLimitHandler_RetryAfter(t *testing.T) {
+	h := &GitHubRateLimitHandler{}
+	resp := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{
+		"Retry-After": {"2"},
+	}}
+
+	wait, retry := h.Handle(resp, nil, 0)
+	if !retry {
+		t.Fatal("Handle() retry = false, want true")
+	}
+	if wait != 2*time.Second {
+		t.Errorf("Handle() wait = %v, want 2s", wait)
+	}
+}
+
+func TestGitHubRateLimitHandler_PrimaryLimit(t *testing.T) {
+	h := &GitHubRateLimitHandler{}
+	reset := time.Now().Add(time.Minute)
+	resp := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{
+		"X-RateLimit-Remaining": {"0"},
+		"X-RateLimit-Reset":     {strconv.FormatInt(reset.Unix(), 10)},
+	}}
+
+	wait, retry := h.Handle(resp, nil, 0)
+	if !retry {
+		t.Fatal("Handle() retry = false, want true")
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("Handle() wait = %v, want roughly up to 1m", wait)
+	}
+}
+
+func TestGitHubRateLimitHandler_SecondaryLimit(t *testing.T) {
+	h := &GitHubRateLimitHandler{}
+	resp := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{}}
+	body := []byte(`{"message": "You have exceeded a secondary rate limit"}`)
+
+	wait, retry := h.Handle(resp, body, 0)
+	if !retry {
+		t.Fatal("Handle() retry = false, want true")
+	}
+	if wait <= 0 {
+		t.Errorf("Handle() wait = %v, want > 0", wait)
+	}
+}
+
+func TestGitHubRateLimitHandler_NotRateLimited(t *testing.T) {
+	h := &GitHubRateLimitHandler{}
+	resp := &http.Response{StatusCode: http.StatusInternalServerError, Header: http.Header{}}
+
+	if _, retry := h.Handle(resp, []byte("boom"), 0); retry {
+		t.Error("Handle() retry = true, want false for an unrelated 500")
+	}
+}
+
+func TestGitHubRateLimitHandler_MaxRetries(t *testing.T) {
+	h := &GitHubRateLimitHandler{MaxRetries: 2}
+	resp := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{
+		"Retry-After": {"1"},
+	}}
+
+	if _, retry := h.Handle(resp, nil, 1); !retry {
+		t.Fatal("Handle() retry = false at attempt 1, want true (< MaxRetries)")
+	}
+	if _, retry := h.Handle(resp, nil, 2); retry {
+		t.Error("Handle() retry = true at attempt 2, want false (== MaxRetries)")
+	}
+}
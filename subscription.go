@@ -0,0 +1,372 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/shurcooL/graphql/internal/jsonutil"
+)
+
+// InitPayload is sent as the payload of the connection_init message when a subscription socket
+// is established. It's the only way to carry auth headers or similar metadata over a WebSocket
+// handshake, which can't carry arbitrary HTTP headers the way Query and Mutate's POSTs can.
+type InitPayload map[string]interface{}
+
+// SetInitPayload sets the payload sent with connection_init on every subscription socket this
+// Client opens. It must be called before the first call to Subscribe.
+func (c *Client) SetInitPayload(payload InitPayload) {
+	c.initPayload = payload
+}
+
+// wsProtocolTransportWS is the only WebSocket subprotocol this client speaks:
+// graphql-transport-ws (https://github.com/enisdenjo/graphql-ws). The legacy Apollo
+// graphql-ws subprotocol uses a different message vocabulary (start/data/stop/connection_error
+// instead of subscribe/next/complete/error) and isn't implemented; don't advertise it here
+// until it is, or a server that only speaks it will negotiate successfully and then have every
+// message silently ignored.
+const wsProtocolTransportWS = "graphql-transport-ws"
+
+// Message types used by the graphql-transport-ws protocol.
+const (
+	msgConnectionInit = "connection_init"
+	msgConnectionAck  = "connection_ack"
+	msgPing           = "ping"
+	msgPong           = "pong"
+	msgSubscribe      = "subscribe"
+	msgNext           = "next"
+	msgError          = "error"
+	msgComplete       = "complete"
+)
+
+// wsMessage is the graphql-transport-ws message envelope.
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Subscription is a single active GraphQL subscription, multiplexed with any other
+// subscriptions the same Client has open over one WebSocket connection.
+type Subscription struct {
+	conn *wsConn
+	id   string
+
+	msgs chan json.RawMessage
+	errs chan error
+	done chan struct{}
+	once sync.Once
+}
+
+// Subscribe starts a GraphQL subscription, with a query derived from subscription, over a
+// WebSocket connection shared with any other subscriptions already open on c. subscription
+// should be a pointer to a struct that corresponds to the GraphQL schema, using the same
+// struct-tag conventions as Query and Mutate.
+func (c *Client) Subscribe(ctx context.Context, subscription interface{}, variables map[string]interface{}) (*Subscription, error) {
+	query := constructSubscription(subscription, variables)
+
+	conn, err := c.wsConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables,omitempty"`
+	}{Query: query, Variables: variables})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Subscription{
+		conn: conn,
+		id:   conn.nextID(),
+		msgs: make(chan json.RawMessage, 1),
+		errs: make(chan error, 1),
+		done: make(chan struct{}),
+	}
+
+	conn.register(s)
+	if err := conn.send(wsMessage{ID: s.id, Type: msgSubscribe, Payload: payload}); err != nil {
+		conn.unregister(s.id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Next blocks until the subscription delivers its next value into v, or returns an error if the
+// subscription errored or was closed. v should be a pointer to the same struct type passed to
+// Subscribe.
+func (s *Subscription) Next(v interface{}) error {
+	select {
+	case raw, ok := <-s.msgs:
+		if !ok {
+			return fmt.Errorf("graphql: subscription %s closed", s.id)
+		}
+		return jsonutil.UnmarshalGraphQL(raw, v)
+	case err := <-s.errs:
+		return err
+	case <-s.done:
+		return fmt.Errorf("graphql: subscription %s closed", s.id)
+	}
+}
+
+// Close ends the subscription, sending a complete message so the server can free its resources.
+// It does not close the underlying WebSocket connection, which may still be serving other
+// subscriptions the Client has open.
+func (s *Subscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.conn.complete(s.id)
+		close(s.done)
+	})
+	return err
+}
+
+// wsConn is a single WebSocket connection multiplexing every subscription a Client has open,
+// keyed by operation id.
+type wsConn struct {
+	conn   *websocket.Conn
+	client *Client // owning Client, so broadcastErr can clear Client.wsConn once this socket dies
+
+	mu   sync.Mutex // guards writes to conn, subs, and next
+	subs map[string]*Subscription
+	next uint64
+
+	ready     chan struct{} // closed once connection_ack arrives (or the socket dies first)
+	readyOnce sync.Once
+}
+
+// wsConnection returns c's shared subscription socket, dialing and completing the
+// connection_init/connection_ack handshake on first use. If a previously returned socket has
+// since died, readLoop clears c.wsConn before this is called again, so a dead connection is
+// redialed rather than handed back forever.
+func (c *Client) wsConnection(ctx context.Context) (*wsConn, error) {
+	c.wsMu.Lock()
+	defer c.wsMu.Unlock()
+	if c.wsConn != nil {
+		return c.wsConn, nil
+	}
+
+	u, err := wsURL(c.url)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{wsProtocolTransportWS}}
+	conn, _, err := dialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	wc := &wsConn{conn: conn, client: c, subs: make(map[string]*Subscription), ready: make(chan struct{})}
+
+	initPayload := json.RawMessage("null")
+	if c.initPayload != nil {
+		if initPayload, err = json.Marshal(c.initPayload); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := wc.send(wsMessage{Type: msgConnectionInit, Payload: initPayload}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go wc.readLoop()
+
+	// A compliant server closes the socket if it receives anything but ping/pong before
+	// acking connection_init, so wait for connection_ack before handing wc back to Subscribe.
+	select {
+	case <-wc.ready:
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	c.wsConn = wc
+	return wc, nil
+}
+
+// wsURL rewrites an http(s) GraphQL endpoint into its ws(s) equivalent.
+func wsURL(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	return u.String(), nil
+}
+
+func (wc *wsConn) nextID() string {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	wc.next++
+	return strconv.FormatUint(wc.next, 10)
+}
+
+func (wc *wsConn) register(s *Subscription) {
+	wc.mu.Lock()
+	wc.subs[s.id] = s
+	wc.mu.Unlock()
+}
+
+func (wc *wsConn) unregister(id string) {
+	wc.mu.Lock()
+	delete(wc.subs, id)
+	wc.mu.Unlock()
+}
+
+func (wc *wsConn) send(m wsMessage) error {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.conn.WriteJSON(m)
+}
+
+func (wc *wsConn) complete(id string) error {
+	wc.mu.Lock()
+	delete(wc.subs, id)
+	wc.mu.Unlock()
+	return wc.send(wsMessage{ID: id, Type: msgComplete})
+}
+
+// readLoop dispatches incoming frames to the subscription they belong to until the connection
+// errors out, at which point every still-open subscription is handed the error. msgNext and
+// msgError are dispatched from their own goroutine: deliver and deliverErr can block on a
+// subscription's buffered channel until its consumer calls Next, and doing that inline here
+// would stall every other subscription multiplexed on the same socket.
+func (wc *wsConn) readLoop() {
+	for {
+		_, data, err := wc.conn.ReadMessage()
+		if err != nil {
+			wc.broadcastErr(err)
+			return
+		}
+
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			continue
+		}
+
+		switch m.Type {
+		case msgConnectionAck:
+			wc.readyOnce.Do(func() { close(wc.ready) })
+		case msgPing:
+			_ = wc.send(wsMessage{Type: msgPong})
+		case msgPong:
+			// Keepalive reply; nothing to do.
+		case msgNext:
+			go wc.deliver(m.ID, m.Payload)
+		case msgError:
+			go wc.deliverErr(m.ID, fmt.Errorf("graphql: subscription error: %s", m.Payload))
+		case msgComplete:
+			wc.finish(m.ID)
+		}
+	}
+}
+
+func (wc *wsConn) deliver(id string, payload json.RawMessage) {
+	wc.mu.Lock()
+	s := wc.subs[id]
+	wc.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	var env struct {
+		Data   *json.RawMessage `json:"data"`
+		Errors GQLErrors        `json:"errors"`
+	}
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return
+	}
+	if env.Data != nil {
+		if cost := extractRateLimitCost(env.Data); cost != nil {
+			wc.client.emitEvent(RateLimitEvent{Type: RateLimitEventCost, Cost: cost})
+			if wc.client.querySink != nil {
+				wc.client.querySink("subscription", cost.Cost, cost.Remaining, cost.ResetAt)
+			}
+		}
+		select {
+		case s.msgs <- *env.Data:
+		case <-s.done:
+		}
+		return
+	}
+	// A next message can carry errors with no data, e.g. a subscription resolver error; report
+	// it instead of silently dropping the message and leaving Next blocked forever.
+	if len(env.Errors) > 0 {
+		select {
+		case s.errs <- env.Errors:
+		case <-s.done:
+		}
+	}
+}
+
+func (wc *wsConn) deliverErr(id string, err error) {
+	wc.mu.Lock()
+	s := wc.subs[id]
+	delete(wc.subs, id)
+	wc.mu.Unlock()
+	if s == nil {
+		return
+	}
+	select {
+	case s.errs <- err:
+	case <-s.done:
+	}
+}
+
+func (wc *wsConn) finish(id string) {
+	wc.mu.Lock()
+	s := wc.subs[id]
+	delete(wc.subs, id)
+	wc.mu.Unlock()
+	if s != nil {
+		close(s.msgs)
+	}
+}
+
+func (wc *wsConn) broadcastErr(err error) {
+	// Unblock a wsConnection call still waiting on the handshake if the socket died first.
+	wc.readyOnce.Do(func() { close(wc.ready) })
+
+	// Clear Client.wsConn so the next Subscribe redials instead of reusing this dead socket.
+	// The identity check guards against a race where the Client has already moved on to a
+	// newer wsConn by the time this one notices its read failed.
+	wc.client.wsMu.Lock()
+	if wc.client.wsConn == wc {
+		wc.client.wsConn = nil
+	}
+	wc.client.wsMu.Unlock()
+
+	wc.mu.Lock()
+	subs := wc.subs
+	wc.subs = make(map[string]*Subscription)
+	wc.mu.Unlock()
+
+	for _, s := range subs {
+		select {
+		case s.errs <- err:
+		case <-s.done:
+		}
+	}
+}
+
+// constructSubscription mirrors constructQuery and constructMutation for the subscribe
+// operation type.
+func constructSubscription(v interface{}, variables map[string]interface{}) string {
+	query := query(v)
+	if len(variables) > 0 {
+		return "subscription(" + queryArguments(variables) + ")" + query
+	}
+	return "subscription" + query
+}
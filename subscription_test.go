@@ -0,0 +1,88 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsEchoServer runs a minimal graphql-transport-ws server: it acks the handshake, then for every
+// subscribe message replies with one next carrying {"name": id} before completing it.
+func wsEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: []string{wsProtocolTransportWS}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Fatalf("upgrade: %v", err)
+		}
+		defer conn.Close()
+
+		for {
+			var m wsMessage
+			if err := conn.ReadJSON(&m); err != nil {
+				return
+			}
+			switch m.Type {
+			case msgConnectionInit:
+				_ = conn.WriteJSON(wsMessage{Type: msgConnectionAck})
+			case msgSubscribe:
+				payload, _ := json.Marshal(map[string]interface{}{
+					"data": map[string]string{"name": m.ID},
+				})
+				_ = conn.WriteJSON(wsMessage{ID: m.ID, Type: msgNext, Payload: payload})
+				_ = conn.WriteJSON(wsMessage{ID: m.ID, Type: msgComplete})
+			}
+		}
+	}))
+}
+
+func TestSubscriptionMultiplexing(t *testing.T) {
+	srv := wsEchoServer(t)
+	defer srv.Close()
+
+	c := NewClient(srv.URL)
+
+	var out1, out2 struct {
+		Name string
+	}
+	s1, err := c.Subscribe(context.Background(), &out1, nil)
+	if err != nil {
+		t.Fatalf("Subscribe 1: %v", err)
+	}
+	defer s1.Close()
+	s2, err := c.Subscribe(context.Background(), &out2, nil)
+	if err != nil {
+		t.Fatalf("Subscribe 2: %v", err)
+	}
+	defer s2.Close()
+
+	// s2 deliberately doesn't call Next yet; s1 must still receive its value promptly, proving
+	// deliver no longer blocks sibling subscriptions from the shared readLoop.
+	done := make(chan error, 1)
+	go func() { done <- s1.Next(&out1) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("s1.Next: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("s1.Next blocked on s2's undelivered message")
+	}
+	if out1.Name != s1.id {
+		t.Errorf("out1.Name = %q, want %q", out1.Name, s1.id)
+	}
+
+	if err := s2.Next(&out2); err != nil {
+		t.Fatalf("s2.Next: %v", err)
+	}
+	if out2.Name != s2.id {
+		t.Errorf("out2.Name = %q, want %q", out2.Name, s2.id)
+	}
+}